@@ -2,20 +2,24 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"flag"
 	"io/ioutil"
 	"log"
+	"os"
 
 	"github.com/robertodauria/ebpf/pkg/vm"
 	"github.com/yalue/elf_reader"
 )
 
 var (
-	flagFilename   = flag.String("filename", "", "Path to the .o file")
-	flagSection    = flag.String("section", "", "ELF section to execute")
-	flagEndianness = flag.Bool("be", false, "Big Endian")
-	flagVerbose    = flag.Bool("v", false, "Be verbose")
+	flagFilename        = flag.String("filename", "", "Path to the .o file")
+	flagSection         = flag.String("section", "", "ELF section to execute")
+	flagEndianness      = flag.Bool("be", false, "Big Endian")
+	flagVerbose         = flag.Bool("v", false, "Be verbose")
+	flagTrace           = flag.String("trace", "", `Trace format: "text" or "jsonl" (disabled if empty)`)
+	flagMaxInstructions = flag.Int("max-instructions", 0, "Compute-unit budget; 0 means unlimited")
 
 	// XXX: endianness should be inferred from the ELF file.
 	endianness binary.ByteOrder
@@ -45,6 +49,22 @@ func main() {
 	var found bool
 	machine := new(vm.VM)
 	machine.Endianness = endianness
+	machine.RegisterDefaultSyscalls()
+
+	machine.MaxInstructions = *flagMaxInstructions
+
+	switch *flagTrace {
+	case "":
+	case "text":
+		machine.Tracer = vm.NewTextTracer(os.Stdout, endianness)
+	case "jsonl":
+		machine.Tracer = vm.NewJSONLTracer(os.Stdout, endianness)
+	default:
+		log.Fatalf("unknown -trace format %q", *flagTrace)
+	}
+	if *flagVerbose && machine.Tracer == nil {
+		machine.Tracer = vm.NewTextTracer(os.Stdout, endianness)
+	}
 
 	// Find the ELF section containing eBPF code.
 	// This is not a fixed name, but depends on the kernel hook BPF code must
@@ -64,26 +84,23 @@ func main() {
 			log.Fatal(err)
 		}
 
-		machine.Load(bytes.NewReader(program))
-	}
-
-	if !found {
-		log.Fatalf("Cannot find section %s", *flagSection)
-	}
-
-	for {
-		instruction, err := machine.Fetch()
+		decoded, err := vm.DecodeProgram(program, endianness)
 		if err != nil {
 			log.Fatal(err)
 		}
-
-		if *flagVerbose {
-			machine.Disassemble(instruction)
+		if err := machine.Load(bytes.NewReader(program)); err != nil {
+			log.Fatal(err)
 		}
-
-		if err := machine.Execute(instruction); err != nil {
+		if err := machine.Verify(decoded); err != nil {
 			log.Fatal(err)
 		}
 	}
 
+	if !found {
+		log.Fatalf("Cannot find section %s", *flagSection)
+	}
+
+	if err := machine.Run(context.Background()); err != nil {
+		log.Fatal(err)
+	}
 }
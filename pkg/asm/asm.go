@@ -0,0 +1,474 @@
+// Package asm implements a human-readable assembly dialect for the eBPF
+// instructions pkg/vm executes: mnemonics like "mov r1, 42", "ldxdw r0,
+// [r1+8]", "jne r1, 0, +3", "lddw r0, 0xdeadbeefcafebabe" and "call 6",
+// assembled from or disassembled back to text via vm.Mnemonics. It lets
+// callers write test programs without a C toolchain.
+package asm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/robertodauria/ebpf/pkg/vm"
+)
+
+// Assemble parses src, a newline-separated program in the dialect described
+// in the package doc, into a decoded instruction stream ready for
+// vm.EncodeProgram. order must match the byte order the result will run
+// under: it decides how each instruction's dst/src nibbles are packed.
+func Assemble(src string, order binary.ByteOrder) ([]vm.Instruction, error) {
+	statements, labels, err := scan(src)
+	if err != nil {
+		return nil, err
+	}
+
+	program := make([]vm.Instruction, 0, len(statements))
+	for _, s := range statements {
+		instrs, err := s.assemble(order, labels)
+		if err != nil {
+			return nil, fmt.Errorf("asm: line %d: %w", s.lineNo, err)
+		}
+		program = append(program, instrs...)
+	}
+	return program, nil
+}
+
+// Disassemble renders program back into the dialect Assemble accepts, one
+// instruction per line, reusing vm.Format so the two packages can never
+// drift out of sync. It does not reconstruct the original labels: jump
+// targets print as the same relative +N/-N offsets Assemble accepts, which
+// keeps the output round-trippable.
+func Disassemble(program []vm.Instruction, order binary.ByteOrder) string {
+	var b strings.Builder
+	for i := 0; i < len(program); i++ {
+		instr := program[i]
+
+		var next *vm.Instruction
+		if instr.Opcode == vm.OpcodeLDDW && i+1 < len(program) {
+			next = &program[i+1]
+		}
+
+		b.WriteString(vm.Format(&instr, next, order))
+		b.WriteByte('\n')
+		if next != nil {
+			i++
+		}
+	}
+	return b.String()
+}
+
+// statement is one parsed, not-yet-encoded line of source.
+type statement struct {
+	lineNo   int
+	mnemonic string
+	mn       vm.Mnemonic
+	operands []string
+	index    int // word index this statement starts at, for jump resolution
+}
+
+// scan splits src into statements and records each label's word index, so
+// forward references resolve in the same pass that encodes them.
+func scan(src string) ([]statement, map[string]int, error) {
+	labels := map[string]int{}
+	var statements []statement
+	index := 0
+
+	for lineNo, raw := range strings.Split(src, "\n") {
+		line := strings.TrimSpace(stripComment(raw))
+		if line == "" {
+			continue
+		}
+		if strings.HasSuffix(line, ":") {
+			labels[strings.TrimSuffix(line, ":")] = index
+			continue
+		}
+
+		mnemonic, rest := splitMnemonic(line)
+		mn, ok := vm.Mnemonics[mnemonic]
+		if !ok {
+			return nil, nil, fmt.Errorf("asm: line %d: unknown mnemonic %q", lineNo+1, mnemonic)
+		}
+
+		statements = append(statements, statement{
+			lineNo:   lineNo + 1,
+			mnemonic: mnemonic,
+			mn:       mn,
+			operands: splitOperands(rest),
+			index:    index,
+		})
+		if mn.Form == vm.FormLDDW {
+			index += 2
+		} else {
+			index++
+		}
+	}
+	return statements, labels, nil
+}
+
+func stripComment(line string) string {
+	if i := strings.IndexAny(line, "#;"); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
+
+func splitMnemonic(line string) (string, string) {
+	fields := strings.SplitN(line, " ", 2)
+	if len(fields) == 1 {
+		return fields[0], ""
+	}
+	return fields[0], fields[1]
+}
+
+func splitOperands(s string) []string {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil
+	}
+	parts := strings.Split(s, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	return parts
+}
+
+func (s statement) operand(i int) string {
+	if i < len(s.operands) {
+		return s.operands[i]
+	}
+	return ""
+}
+
+func (s statement) require(n int) error {
+	if len(s.operands) != n {
+		return fmt.Errorf("%s expects %d operand(s), got %d", s.mnemonic, n, len(s.operands))
+	}
+	return nil
+}
+
+// assemble encodes one statement into one instruction, or two for lddw.
+func (s statement) assemble(order binary.ByteOrder, labels map[string]int) ([]vm.Instruction, error) {
+	switch s.mn.Form {
+	case vm.FormAluImm:
+		return s.assembleAlu(order)
+	case vm.FormUnary:
+		return s.assembleUnary(order)
+	case vm.FormEndian:
+		return s.assembleEndian(order)
+	case vm.FormJumpImm:
+		return s.assembleJump(order, labels)
+	case vm.FormJA:
+		return s.assembleJA(labels)
+	case vm.FormCall:
+		return s.assembleCall()
+	case vm.FormExit:
+		return s.assembleExit()
+	case vm.FormLDDW:
+		return s.assembleLDDW(order)
+	case vm.FormLDX:
+		return s.assembleLDX(order)
+	case vm.FormSTX:
+		return s.assembleSTX(order)
+	case vm.FormST:
+		return s.assembleST(order)
+	case vm.FormLDABS:
+		return s.assembleLDABS()
+	case vm.FormLDIND:
+		return s.assembleLDIND(order)
+	default:
+		return nil, fmt.Errorf("%s: unsupported operand form", s.mnemonic)
+	}
+}
+
+func one(i vm.Instruction) []vm.Instruction { return []vm.Instruction{i} }
+
+func (s statement) assembleAlu(order binary.ByteOrder) ([]vm.Instruction, error) {
+	if err := s.require(2); err != nil {
+		return nil, err
+	}
+	dst, err := parseRegister(s.operand(0))
+	if err != nil {
+		return nil, err
+	}
+
+	if src, ok := tryParseRegister(s.operand(1)); ok {
+		if s.mn.Reg == 0 {
+			return nil, fmt.Errorf("%s has no register form", s.mnemonic)
+		}
+		return one(vm.Instruction{Opcode: s.mn.Reg, DstSrc: vm.EncodeDstSrc(dst, src, order)}), nil
+	}
+
+	imm, err := parseInt32(s.operand(1))
+	if err != nil {
+		return nil, err
+	}
+	return one(vm.Instruction{Opcode: s.mn.Imm, DstSrc: vm.EncodeDstSrc(dst, 0, order), Immediate: imm}), nil
+}
+
+func (s statement) assembleUnary(order binary.ByteOrder) ([]vm.Instruction, error) {
+	if err := s.require(1); err != nil {
+		return nil, err
+	}
+	dst, err := parseRegister(s.operand(0))
+	if err != nil {
+		return nil, err
+	}
+	return one(vm.Instruction{Opcode: s.mn.Imm, DstSrc: vm.EncodeDstSrc(dst, 0, order)}), nil
+}
+
+func (s statement) assembleEndian(order binary.ByteOrder) ([]vm.Instruction, error) {
+	if err := s.require(1); err != nil {
+		return nil, err
+	}
+	dst, err := parseRegister(s.operand(0))
+	if err != nil {
+		return nil, err
+	}
+	width, err := endianWidth(s.mnemonic)
+	if err != nil {
+		return nil, err
+	}
+	return one(vm.Instruction{Opcode: s.mn.Imm, DstSrc: vm.EncodeDstSrc(dst, 0, order), Immediate: width}), nil
+}
+
+func (s statement) assembleJump(order binary.ByteOrder, labels map[string]int) ([]vm.Instruction, error) {
+	if err := s.require(3); err != nil {
+		return nil, err
+	}
+	dst, err := parseRegister(s.operand(0))
+	if err != nil {
+		return nil, err
+	}
+	off, err := resolveTarget(s.operand(2), s.index, labels)
+	if err != nil {
+		return nil, err
+	}
+
+	if src, ok := tryParseRegister(s.operand(1)); ok {
+		return one(vm.Instruction{Opcode: s.mn.Reg, DstSrc: vm.EncodeDstSrc(dst, src, order), Offset: off}), nil
+	}
+	imm, err := parseInt32(s.operand(1))
+	if err != nil {
+		return nil, err
+	}
+	return one(vm.Instruction{Opcode: s.mn.Imm, DstSrc: vm.EncodeDstSrc(dst, 0, order), Offset: off, Immediate: imm}), nil
+}
+
+func (s statement) assembleJA(labels map[string]int) ([]vm.Instruction, error) {
+	if err := s.require(1); err != nil {
+		return nil, err
+	}
+	off, err := resolveTarget(s.operand(0), s.index, labels)
+	if err != nil {
+		return nil, err
+	}
+	return one(vm.Instruction{Opcode: s.mn.Imm, Offset: off}), nil
+}
+
+func (s statement) assembleCall() ([]vm.Instruction, error) {
+	if err := s.require(1); err != nil {
+		return nil, err
+	}
+	imm, err := parseInt32(s.operand(0))
+	if err != nil {
+		return nil, err
+	}
+	return one(vm.Instruction{Opcode: s.mn.Imm, Immediate: imm}), nil
+}
+
+func (s statement) assembleExit() ([]vm.Instruction, error) {
+	if err := s.require(0); err != nil {
+		return nil, err
+	}
+	return one(vm.Instruction{Opcode: s.mn.Imm}), nil
+}
+
+func (s statement) assembleLDDW(order binary.ByteOrder) ([]vm.Instruction, error) {
+	if err := s.require(2); err != nil {
+		return nil, err
+	}
+	dst, err := parseRegister(s.operand(0))
+	if err != nil {
+		return nil, err
+	}
+	imm, err := parseInt64(s.operand(1))
+	if err != nil {
+		return nil, err
+	}
+
+	lo := int32(uint32(imm))
+	hi := int32(uint32(imm >> 32))
+	return []vm.Instruction{
+		{Opcode: s.mn.Imm, DstSrc: vm.EncodeDstSrc(dst, 0, order), Immediate: lo},
+		{Immediate: hi},
+	}, nil
+}
+
+func (s statement) assembleLDX(order binary.ByteOrder) ([]vm.Instruction, error) {
+	if err := s.require(2); err != nil {
+		return nil, err
+	}
+	dst, err := parseRegister(s.operand(0))
+	if err != nil {
+		return nil, err
+	}
+	src, off, err := parseMemOperand(s.operand(1))
+	if err != nil {
+		return nil, err
+	}
+	return one(vm.Instruction{Opcode: s.mn.Imm, DstSrc: vm.EncodeDstSrc(dst, src, order), Offset: off}), nil
+}
+
+func (s statement) assembleSTX(order binary.ByteOrder) ([]vm.Instruction, error) {
+	if err := s.require(2); err != nil {
+		return nil, err
+	}
+	dst, off, err := parseMemOperand(s.operand(0))
+	if err != nil {
+		return nil, err
+	}
+	src, err := parseRegister(s.operand(1))
+	if err != nil {
+		return nil, err
+	}
+	return one(vm.Instruction{Opcode: s.mn.Imm, DstSrc: vm.EncodeDstSrc(dst, src, order), Offset: off}), nil
+}
+
+func (s statement) assembleST(order binary.ByteOrder) ([]vm.Instruction, error) {
+	if err := s.require(2); err != nil {
+		return nil, err
+	}
+	dst, off, err := parseMemOperand(s.operand(0))
+	if err != nil {
+		return nil, err
+	}
+	imm, err := parseInt32(s.operand(1))
+	if err != nil {
+		return nil, err
+	}
+	return one(vm.Instruction{Opcode: s.mn.Imm, DstSrc: vm.EncodeDstSrc(dst, 0, order), Offset: off, Immediate: imm}), nil
+}
+
+func (s statement) assembleLDABS() ([]vm.Instruction, error) {
+	if err := s.require(1); err != nil {
+		return nil, err
+	}
+	imm, err := parseInt32(s.operand(0))
+	if err != nil {
+		return nil, err
+	}
+	return one(vm.Instruction{Opcode: s.mn.Imm, Immediate: imm}), nil
+}
+
+func (s statement) assembleLDIND(order binary.ByteOrder) ([]vm.Instruction, error) {
+	if err := s.require(2); err != nil {
+		return nil, err
+	}
+	src, err := parseRegister(s.operand(0))
+	if err != nil {
+		return nil, err
+	}
+	imm, err := parseInt32(s.operand(1))
+	if err != nil {
+		return nil, err
+	}
+	return one(vm.Instruction{Opcode: s.mn.Imm, DstSrc: vm.EncodeDstSrc(0, src, order), Immediate: imm}), nil
+}
+
+func parseRegister(s string) (uint8, error) {
+	n, ok := tryParseRegister(s)
+	if !ok {
+		return 0, fmt.Errorf("%q is not a register", s)
+	}
+	return n, nil
+}
+
+func tryParseRegister(s string) (uint8, bool) {
+	if len(s) < 2 || s[0] != 'r' {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(s[1:], 10, 8)
+	if err != nil || n >= vm.NumRegisters {
+		return 0, false
+	}
+	return uint8(n), true
+}
+
+func parseInt32(s string) (int32, error) {
+	n, err := parseInt64(s)
+	if err != nil {
+		return 0, err
+	}
+	return int32(n), nil
+}
+
+func parseInt64(s string) (int64, error) {
+	if n, err := strconv.ParseInt(s, 0, 64); err == nil {
+		return n, nil
+	}
+	if u, err := strconv.ParseUint(s, 0, 64); err == nil {
+		return int64(u), nil
+	}
+	return 0, fmt.Errorf("%q is not a valid integer", s)
+}
+
+// parseMemOperand parses a "[reg+off]", "[reg-off]" or "[reg]" operand.
+func parseMemOperand(s string) (uint8, int16, error) {
+	if len(s) < 3 || s[0] != '[' || s[len(s)-1] != ']' {
+		return 0, 0, fmt.Errorf("%q is not a memory operand", s)
+	}
+	inner := s[1 : len(s)-1]
+
+	regEnd := 1
+	for regEnd < len(inner) && inner[regEnd] >= '0' && inner[regEnd] <= '9' {
+		regEnd++
+	}
+	reg, ok := tryParseRegister(inner[:regEnd])
+	if !ok {
+		return 0, 0, fmt.Errorf("%q is not a memory operand", s)
+	}
+
+	rest := strings.TrimSpace(inner[regEnd:])
+	if rest == "" {
+		return reg, 0, nil
+	}
+	off, err := parseInt64(rest)
+	if err != nil || off < -1<<15 || off > 1<<15-1 {
+		return 0, 0, fmt.Errorf("%q has an invalid offset", s)
+	}
+	return reg, int16(off), nil
+}
+
+// resolveTarget turns a jump operand into a PC-relative word offset: either
+// a literal "+3"/"-1" or a label name, resolved against the word index the
+// jump itself occupies. This matches VM.Fetch's PC += offset semantics,
+// where PC has already advanced past the branch instruction by the time the
+// jump executes.
+func resolveTarget(s string, index int, labels map[string]int) (int16, error) {
+	if s == "" {
+		return 0, fmt.Errorf("missing jump target")
+	}
+	if s[0] == '+' || s[0] == '-' || (s[0] >= '0' && s[0] <= '9') {
+		if n, err := parseInt64(s); err == nil {
+			return int16(n), nil
+		}
+	}
+
+	target, ok := labels[s]
+	if !ok {
+		return 0, fmt.Errorf("undefined label %q", s)
+	}
+	return int16(target - (index + 1)), nil
+}
+
+// endianWidth extracts the byteswap width out of a "le16"/"be32"/"le64"
+// style mnemonic name.
+func endianWidth(mnemonic string) (int32, error) {
+	width, err := strconv.Atoi(mnemonic[2:])
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a valid byteswap width", mnemonic)
+	}
+	return int32(width), nil
+}
@@ -0,0 +1,254 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// ErrDivideByZero is returned when a DIV or MOD instruction's divisor
+// evaluates to zero at runtime, whether the divisor comes from an
+// immediate or from a register.
+var ErrDivideByZero = errors.New("vm: division or modulo by zero")
+
+// signExtendImmediate sign-extends a 32-bit immediate into a 64-bit value,
+// as required by BPF_K operands of ALU64/JMP instructions.
+func signExtendImmediate(imm int32) uint64 {
+	return uint64(int64(imm))
+}
+
+// aluK64 builds an opFunc for an ALU64 instruction using the immediate as
+// its right-hand operand: dst = f(dst, imm).
+func aluK64(f func(dst, src uint64) uint64) opFunc {
+	return func(vm *VM, instr *Instruction) error {
+		dst := vm.getDst(instr)
+		vm.setRegister(dst, f(vm.getRegister(dst), signExtendImmediate(instr.Immediate)))
+		return nil
+	}
+}
+
+// aluX64 builds an opFunc for an ALU64 instruction using the src register
+// as its right-hand operand: dst = f(dst, src).
+func aluX64(f func(dst, src uint64) uint64) opFunc {
+	return func(vm *VM, instr *Instruction) error {
+		dst := vm.getDst(instr)
+		src := vm.getSrc(instr)
+		vm.setRegister(dst, f(vm.getRegister(dst), vm.getRegister(src)))
+		return nil
+	}
+}
+
+// aluK32 and aluX32 are the ALU32 equivalents of aluK64/aluX64: they operate
+// on the low 32 bits of their operands and zero-extend the result into dst,
+// matching the eBPF ALU32 semantics.
+func aluK32(f func(dst, src uint32) uint32) opFunc {
+	return func(vm *VM, instr *Instruction) error {
+		dst := vm.getDst(instr)
+		res := f(uint32(vm.getRegister(dst)), uint32(instr.Immediate))
+		vm.setRegister(dst, uint64(res))
+		return nil
+	}
+}
+
+func aluX32(f func(dst, src uint32) uint32) opFunc {
+	return func(vm *VM, instr *Instruction) error {
+		dst := vm.getDst(instr)
+		src := vm.getSrc(instr)
+		res := f(uint32(vm.getRegister(dst)), uint32(vm.getRegister(src)))
+		vm.setRegister(dst, uint64(res))
+		return nil
+	}
+}
+
+// aluDivK64, aluDivX64, aluDivK32, aluDivX32 and their Mod counterparts wrap
+// the plain ALU helpers above to turn a zero divisor into ErrDivideByZero
+// instead of letting Go panic.
+func aluDivK64(f func(dst, src uint64) uint64) opFunc {
+	return func(vm *VM, instr *Instruction) error {
+		divisor := signExtendImmediate(instr.Immediate)
+		if divisor == 0 {
+			return ErrDivideByZero
+		}
+		dst := vm.getDst(instr)
+		vm.setRegister(dst, f(vm.getRegister(dst), divisor))
+		return nil
+	}
+}
+
+func aluDivX64(f func(dst, src uint64) uint64) opFunc {
+	return func(vm *VM, instr *Instruction) error {
+		divisor := vm.getRegister(vm.getSrc(instr))
+		if divisor == 0 {
+			return ErrDivideByZero
+		}
+		dst := vm.getDst(instr)
+		vm.setRegister(dst, f(vm.getRegister(dst), divisor))
+		return nil
+	}
+}
+
+func aluDivK32(f func(dst, src uint32) uint32) opFunc {
+	return func(vm *VM, instr *Instruction) error {
+		divisor := uint32(instr.Immediate)
+		if divisor == 0 {
+			return ErrDivideByZero
+		}
+		dst := vm.getDst(instr)
+		res := f(uint32(vm.getRegister(dst)), divisor)
+		vm.setRegister(dst, uint64(res))
+		return nil
+	}
+}
+
+func aluDivX32(f func(dst, src uint32) uint32) opFunc {
+	return func(vm *VM, instr *Instruction) error {
+		divisor := uint32(vm.getRegister(vm.getSrc(instr)))
+		if divisor == 0 {
+			return ErrDivideByZero
+		}
+		dst := vm.getDst(instr)
+		res := f(uint32(vm.getRegister(dst)), divisor)
+		vm.setRegister(dst, uint64(res))
+		return nil
+	}
+}
+
+// aluNeg64 and aluNeg32 implement the unary NEG instruction, which ignores
+// the src/imm fields entirely.
+func aluNeg64(vm *VM, instr *Instruction) error {
+	dst := vm.getDst(instr)
+	vm.setRegister(dst, uint64(-int64(vm.getRegister(dst))))
+	return nil
+}
+
+func aluNeg32(vm *VM, instr *Instruction) error {
+	dst := vm.getDst(instr)
+	vm.setRegister(dst, uint64(uint32(-int32(vm.getRegister(dst)))))
+	return nil
+}
+
+// aluEndian builds an opFunc for the BPF_END family: to selects little- or
+// big-endian conversion of the low 16/32/64 bits of dst, per instr.Immediate.
+func aluEndian(to ByteOrderKind) opFunc {
+	return func(vm *VM, instr *Instruction) error {
+		dst := vm.getDst(instr)
+		val := vm.getRegister(dst)
+
+		switch instr.Immediate {
+		case 16:
+			val &= 0xffff
+			if to == bigEndian {
+				val = uint64(bits.ReverseBytes16(uint16(val)))
+			}
+		case 32:
+			val &= 0xffffffff
+			if to == bigEndian {
+				val = uint64(bits.ReverseBytes32(uint32(val)))
+			}
+		case 64:
+			if to == bigEndian {
+				val = bits.ReverseBytes64(val)
+			}
+		default:
+			return fmt.Errorf("vm: invalid byteswap width %d", instr.Immediate)
+		}
+
+		vm.setRegister(dst, val)
+		return nil
+	}
+}
+
+// ByteOrderKind distinguishes the two BPF_END conversions. It is deliberately
+// not binary.ByteOrder: BPF_END operates on register values, not on a byte
+// stream, and host endianness never enters into it.
+type ByteOrderKind int
+
+const (
+	littleEndian ByteOrderKind = iota
+	bigEndian
+)
+
+func addU64(a, b uint64) uint64  { return a + b }
+func subU64(a, b uint64) uint64  { return a - b }
+func mulU64(a, b uint64) uint64  { return a * b }
+func orU64(a, b uint64) uint64   { return a | b }
+func andU64(a, b uint64) uint64  { return a & b }
+func xorU64(a, b uint64) uint64  { return a ^ b }
+func movU64(_, b uint64) uint64  { return b }
+func lshU64(a, b uint64) uint64  { return a << (b & 63) }
+func rshU64(a, b uint64) uint64  { return a >> (b & 63) }
+func arshU64(a, b uint64) uint64 { return uint64(int64(a) >> (b & 63)) }
+func divU64(a, b uint64) uint64  { return a / b }
+func modU64(a, b uint64) uint64  { return a % b }
+
+func addU32(a, b uint32) uint32  { return a + b }
+func subU32(a, b uint32) uint32  { return a - b }
+func mulU32(a, b uint32) uint32  { return a * b }
+func orU32(a, b uint32) uint32   { return a | b }
+func andU32(a, b uint32) uint32  { return a & b }
+func xorU32(a, b uint32) uint32  { return a ^ b }
+func movU32(_, b uint32) uint32  { return b }
+func lshU32(a, b uint32) uint32  { return a << (b & 31) }
+func rshU32(a, b uint32) uint32  { return a >> (b & 31) }
+func arshU32(a, b uint32) uint32 { return uint32(int32(a) >> (b & 31)) }
+func divU32(a, b uint32) uint32  { return a / b }
+func modU32(a, b uint32) uint32  { return a % b }
+
+func init() {
+	registerOpcodes(map[uint8]opFunc{
+		OpcodeADDIMM:    aluK64(addU64),
+		OpcodeADDSRC:    aluX64(addU64),
+		OpcodeSUBIMM:    aluK64(subU64),
+		OpcodeSUBSRC:    aluX64(subU64),
+		OpcodeMULIMM:    aluK64(mulU64),
+		OpcodeMULSRC:    aluX64(mulU64),
+		OpcodeDIVIMM:    aluDivK64(divU64),
+		OpcodeDIVSRC:    aluDivX64(divU64),
+		OpcodeORIMM:     aluK64(orU64),
+		OpcodeORSRC:     aluX64(orU64),
+		OpcodeANDIMM:    aluK64(andU64),
+		OpcodeANDSRC:    aluX64(andU64),
+		OpcodeLSHIMM:    aluK64(lshU64),
+		OpcodeLSHSRC:    aluX64(lshU64),
+		OpcodeRSHIMM:    aluK64(rshU64),
+		OpcodeRSHSRC:    aluX64(rshU64),
+		OpcodeNEG:       aluNeg64,
+		OpcodeMODIMM:    aluDivK64(modU64),
+		OpcodeMODSRC:    aluDivX64(modU64),
+		OpcodeXORIMM:    aluK64(xorU64),
+		OpcodeXORSRC:    aluX64(xorU64),
+		OpcodeMOVDSTIMM: aluK64(movU64),
+		OpcodeMOVDSTSRC: aluX64(movU64),
+		OpcodeARSHIMM:   aluK64(arshU64),
+		OpcodeARSHSRC:   aluX64(arshU64),
+
+		OpcodeADD32IMM:    aluK32(addU32),
+		OpcodeADD32SRC:    aluX32(addU32),
+		OpcodeSUB32IMM:    aluK32(subU32),
+		OpcodeSUB32SRC:    aluX32(subU32),
+		OpcodeMUL32IMM:    aluK32(mulU32),
+		OpcodeMUL32SRC:    aluX32(mulU32),
+		OpcodeDIV32IMM:    aluDivK32(divU32),
+		OpcodeDIV32SRC:    aluDivX32(divU32),
+		OpcodeOR32IMM:     aluK32(orU32),
+		OpcodeOR32SRC:     aluX32(orU32),
+		OpcodeAND32IMM:    aluK32(andU32),
+		OpcodeAND32SRC:    aluX32(andU32),
+		OpcodeLSH32IMM:    aluK32(lshU32),
+		OpcodeLSH32SRC:    aluX32(lshU32),
+		OpcodeRSH32IMM:    aluK32(rshU32),
+		OpcodeRSH32SRC:    aluX32(rshU32),
+		OpcodeNEG32:       aluNeg32,
+		OpcodeMOD32IMM:    aluDivK32(modU32),
+		OpcodeMOD32SRC:    aluDivX32(modU32),
+		OpcodeXOR32IMM:    aluK32(xorU32),
+		OpcodeXOR32SRC:    aluX32(xorU32),
+		OpcodeMOV32DSTIMM: aluK32(movU32),
+		OpcodeMOV32DSTSRC: aluX32(movU32),
+		OpcodeARSH32IMM:   aluK32(arshU32),
+		OpcodeARSH32SRC:   aluX32(arshU32),
+
+		OpcodeLE: aluEndian(littleEndian),
+		OpcodeBE: aluEndian(bigEndian),
+	})
+}
@@ -1,6 +1,13 @@
 package vm
 
-import "fmt"
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// InstructionSize is the encoded size of an Instruction, in bytes.
+const InstructionSize = 8
 
 // Instruction represents a eBPF instruction.
 //
@@ -42,3 +49,32 @@ func (i *Instruction) String() string {
 	return fmt.Sprintf("opcode: %#02x, dstsrc: %b, offset: %d, imm: %d",
 		i.Opcode, i.DstSrc, i.Offset, i.Immediate)
 }
+
+// DecodeProgram decodes a raw program image into the Instruction slice
+// Verify expects. data's length must be a multiple of InstructionSize.
+func DecodeProgram(data []byte, order binary.ByteOrder) ([]Instruction, error) {
+	if len(data)%InstructionSize != 0 {
+		return nil, fmt.Errorf("vm: program length %d is not a multiple of %d", len(data), InstructionSize)
+	}
+
+	program := make([]Instruction, len(data)/InstructionSize)
+	r := bytes.NewReader(data)
+	for i := range program {
+		if err := binary.Read(r, order, &program[i]); err != nil {
+			return nil, err
+		}
+	}
+	return program, nil
+}
+
+// EncodeProgram is the inverse of DecodeProgram: it serializes program into
+// a raw image using the given byte order.
+func EncodeProgram(program []Instruction, order binary.ByteOrder) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	for _, instr := range program {
+		if err := binary.Write(buf, order, instr); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,131 @@
+package vm
+
+// jumpK64 builds an opFunc for a BPF_JMP (64-bit) instruction that compares
+// dst against the sign-extended immediate and branches by instr.Offset when
+// cond holds.
+func jumpK64(cond func(a, b uint64) bool) opFunc {
+	return func(vm *VM, instr *Instruction) error {
+		dst := vm.getRegister(vm.getDst(instr))
+		if cond(dst, signExtendImmediate(instr.Immediate)) {
+			vm.PC += int(instr.Offset)
+		}
+		return nil
+	}
+}
+
+// jumpX64 is the BPF_JMP (64-bit) equivalent of jumpK64 that compares dst
+// against the src register.
+func jumpX64(cond func(a, b uint64) bool) opFunc {
+	return func(vm *VM, instr *Instruction) error {
+		dst := vm.getRegister(vm.getDst(instr))
+		src := vm.getRegister(vm.getSrc(instr))
+		if cond(dst, src) {
+			vm.PC += int(instr.Offset)
+		}
+		return nil
+	}
+}
+
+// jumpK32 and jumpX32 are the BPF_JMP32 equivalents of jumpK64/jumpX64: the
+// comparison only considers the low 32 bits of each operand.
+func jumpK32(cond func(a, b uint32) bool) opFunc {
+	return func(vm *VM, instr *Instruction) error {
+		dst := uint32(vm.getRegister(vm.getDst(instr)))
+		if cond(dst, uint32(instr.Immediate)) {
+			vm.PC += int(instr.Offset)
+		}
+		return nil
+	}
+}
+
+func jumpX32(cond func(a, b uint32) bool) opFunc {
+	return func(vm *VM, instr *Instruction) error {
+		dst := uint32(vm.getRegister(vm.getDst(instr)))
+		src := uint32(vm.getRegister(vm.getSrc(instr)))
+		if cond(dst, src) {
+			vm.PC += int(instr.Offset)
+		}
+		return nil
+	}
+}
+
+// jumpAlways implements JA: an unconditional PC-relative branch.
+func jumpAlways(vm *VM, instr *Instruction) error {
+	vm.PC += int(instr.Offset)
+	return nil
+}
+
+func jeq64(a, b uint64) bool  { return a == b }
+func jne64(a, b uint64) bool  { return a != b }
+func jgt64(a, b uint64) bool  { return a > b }
+func jge64(a, b uint64) bool  { return a >= b }
+func jlt64(a, b uint64) bool  { return a < b }
+func jle64(a, b uint64) bool  { return a <= b }
+func jset64(a, b uint64) bool { return a&b != 0 }
+func jsgt64(a, b uint64) bool { return int64(a) > int64(b) }
+func jsge64(a, b uint64) bool { return int64(a) >= int64(b) }
+func jslt64(a, b uint64) bool { return int64(a) < int64(b) }
+func jsle64(a, b uint64) bool { return int64(a) <= int64(b) }
+
+func jeq32(a, b uint32) bool  { return a == b }
+func jne32(a, b uint32) bool  { return a != b }
+func jgt32(a, b uint32) bool  { return a > b }
+func jge32(a, b uint32) bool  { return a >= b }
+func jlt32(a, b uint32) bool  { return a < b }
+func jle32(a, b uint32) bool  { return a <= b }
+func jset32(a, b uint32) bool { return a&b != 0 }
+func jsgt32(a, b uint32) bool { return int32(a) > int32(b) }
+func jsge32(a, b uint32) bool { return int32(a) >= int32(b) }
+func jslt32(a, b uint32) bool { return int32(a) < int32(b) }
+func jsle32(a, b uint32) bool { return int32(a) <= int32(b) }
+
+func init() {
+	registerOpcodes(map[uint8]opFunc{
+		OpcodeJA:      jumpAlways,
+		OpcodeJEQIMM:  jumpK64(jeq64),
+		OpcodeJEQSRC:  jumpX64(jeq64),
+		OpcodeJGTIMM:  jumpK64(jgt64),
+		OpcodeJGTSRC:  jumpX64(jgt64),
+		OpcodeJGEIMM:  jumpK64(jge64),
+		OpcodeJGESRC:  jumpX64(jge64),
+		OpcodeJSETIMM: jumpK64(jset64),
+		OpcodeJSETSRC: jumpX64(jset64),
+		OpcodeJNEIMM:  jumpK64(jne64),
+		OpcodeJNESRC:  jumpX64(jne64),
+		OpcodeJSGTIMM: jumpK64(jsgt64),
+		OpcodeJSGTSRC: jumpX64(jsgt64),
+		OpcodeJSGEIMM: jumpK64(jsge64),
+		OpcodeJSGESRC: jumpX64(jsge64),
+		OpcodeJLTIMM:  jumpK64(jlt64),
+		OpcodeJLTSRC:  jumpX64(jlt64),
+		OpcodeJLEIMM:  jumpK64(jle64),
+		OpcodeJLESRC:  jumpX64(jle64),
+		OpcodeJSLTIMM: jumpK64(jslt64),
+		OpcodeJSLTSRC: jumpX64(jslt64),
+		OpcodeJSLEIMM: jumpK64(jsle64),
+		OpcodeJSLESRC: jumpX64(jsle64),
+
+		OpcodeJEQ32IMM:  jumpK32(jeq32),
+		OpcodeJEQ32SRC:  jumpX32(jeq32),
+		OpcodeJGT32IMM:  jumpK32(jgt32),
+		OpcodeJGT32SRC:  jumpX32(jgt32),
+		OpcodeJGE32IMM:  jumpK32(jge32),
+		OpcodeJGE32SRC:  jumpX32(jge32),
+		OpcodeJSET32IMM: jumpK32(jset32),
+		OpcodeJSET32SRC: jumpX32(jset32),
+		OpcodeJNE32IMM:  jumpK32(jne32),
+		OpcodeJNE32SRC:  jumpX32(jne32),
+		OpcodeJSGT32IMM: jumpK32(jsgt32),
+		OpcodeJSGT32SRC: jumpX32(jsgt32),
+		OpcodeJSGE32IMM: jumpK32(jsge32),
+		OpcodeJSGE32SRC: jumpX32(jsge32),
+		OpcodeJLT32IMM:  jumpK32(jlt32),
+		OpcodeJLT32SRC:  jumpX32(jlt32),
+		OpcodeJLE32IMM:  jumpK32(jle32),
+		OpcodeJLE32SRC:  jumpX32(jle32),
+		OpcodeJSLT32IMM: jumpK32(jslt32),
+		OpcodeJSLT32SRC: jumpX32(jslt32),
+		OpcodeJSLE32IMM: jumpK32(jsle32),
+		OpcodeJSLE32SRC: jumpX32(jsle32),
+	})
+}
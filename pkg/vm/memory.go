@@ -0,0 +1,131 @@
+package vm
+
+import "fmt"
+
+// Virtual address layout for the regions making up a program's address
+// space. Each region is given its own value in bits 32-35 so that a stray pointer
+// into the wrong region is immediately obvious from its VA, the same
+// convention used by rbpf/sbpf.
+const (
+	ProgramVA = 0x1_0000_0000
+	StackVA   = 0x2_0000_0000
+	HeapVA    = 0x3_0000_0000
+	InputVA   = 0x4_0000_0000
+
+	// DefaultHeapSize is the size given to the heap region when none is
+	// requested explicitly.
+	DefaultHeapSize = 1 << 12
+)
+
+// Region is a contiguous range of the virtual address space backed by a
+// host slice.
+type Region struct {
+	// Name identifies the region in error messages (e.g. "stack").
+	Name string
+
+	// VA is the first virtual address mapped by this region.
+	VA uint64
+
+	// Data is the host-backed storage for the region. Its length is the
+	// region's size.
+	Data []byte
+
+	// Writable reports whether STX/ST instructions may write to this
+	// region. Loads are always permitted.
+	Writable bool
+}
+
+// contains reports whether the [vaddr, vaddr+size) range lies entirely
+// within the region.
+func (r *Region) contains(vaddr, size uint64) bool {
+	end := vaddr + size
+	return vaddr >= r.VA && end >= vaddr && end <= r.VA+uint64(len(r.Data))
+}
+
+// AccessViolation is returned by MemoryMapping.Translate when a load or
+// store falls outside every mapped region, or writes to a read-only one.
+type AccessViolation struct {
+	VA    uint64
+	Size  uint64
+	Write bool
+	PC    int
+}
+
+func (e *AccessViolation) Error() string {
+	op := "read"
+	if e.Write {
+		op = "write"
+	}
+	return fmt.Sprintf("vm: access violation at pc=%d: %s of %d byte(s) at va=%#x", e.PC, op, e.Size, e.VA)
+}
+
+// MemoryMapping is the region-based virtual address space of a running
+// program: read-only program/rodata, a stack that grows down from the top
+// of its region, a heap, and a caller-supplied input (packet) buffer.
+type MemoryMapping struct {
+	Program *Region
+	Stack   *Region
+	Heap    *Region
+	Input   *Region
+}
+
+// NewMemoryMapping builds the standard region layout for a program. program
+// becomes the read-only program/rodata region; input may be nil or resized
+// later with VM.SetInput.
+func NewMemoryMapping(program []byte, stackSize, heapSize int, input []byte) *MemoryMapping {
+	return &MemoryMapping{
+		Program: &Region{Name: "program", VA: ProgramVA, Data: program, Writable: false},
+		Stack:   &Region{Name: "stack", VA: StackVA, Data: make([]byte, stackSize), Writable: true},
+		Heap:    &Region{Name: "heap", VA: HeapVA, Data: make([]byte, heapSize), Writable: true},
+		Input:   &Region{Name: "input", VA: InputVA, Data: input, Writable: true},
+	}
+}
+
+// regions returns the mapping's regions in lookup order.
+func (m *MemoryMapping) regions() [4]*Region {
+	return [4]*Region{m.Program, m.Stack, m.Heap, m.Input}
+}
+
+// Translate finds the region covering [vaddr, vaddr+size), checks that
+// write accesses only target a writable region, and returns the
+// corresponding host slice. It returns an *AccessViolation on any
+// out-of-bounds or permission failure.
+func (m *MemoryMapping) Translate(vaddr, size uint64, write bool) ([]byte, error) {
+	for _, r := range m.regions() {
+		if r == nil || !r.contains(vaddr, size) {
+			continue
+		}
+		if write && !r.Writable {
+			return nil, &AccessViolation{VA: vaddr, Size: size, Write: write}
+		}
+		off := vaddr - r.VA
+		return r.Data[off : off+size], nil
+	}
+	return nil, &AccessViolation{VA: vaddr, Size: size, Write: write}
+}
+
+// translate is Translate with the VM's current PC stamped onto any
+// resulting AccessViolation, so callers get an actionable error without
+// having to thread the PC through themselves.
+func (vm *VM) translate(vaddr, size uint64, write bool) ([]byte, error) {
+	b, err := vm.Memory.Translate(vaddr, size, write)
+	if err != nil {
+		if av, ok := err.(*AccessViolation); ok {
+			av.PC = vm.PC
+		}
+		return nil, err
+	}
+	if write && vm.Tracer != nil {
+		// b aliases the region's backing array, so it reflects whatever the
+		// caller goes on to write into it by the time Execute reports it.
+		vm.pendingWrites = append(vm.pendingWrites, pendingWrite{va: vaddr, data: b})
+	}
+	return b, nil
+}
+
+// SetInput installs the caller-supplied input (packet) buffer. R1 keeps
+// pointing at the input region's VA across calls, since that VA never
+// changes, only the backing data it points to.
+func (vm *VM) SetInput(data []byte) {
+	vm.Memory.Input.Data = data
+}
@@ -0,0 +1,149 @@
+package vm
+
+// readSize and writeSize decode/encode a 1/2/4/8-byte value at the VM's
+// configured endianness; size must be one of those four values.
+func readSize(vm *VM, b []byte, size int) uint64 {
+	switch size {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(vm.Endianness.Uint16(b))
+	case 4:
+		return uint64(vm.Endianness.Uint32(b))
+	default:
+		return vm.Endianness.Uint64(b)
+	}
+}
+
+func writeSize(vm *VM, b []byte, size int, val uint64) {
+	switch size {
+	case 1:
+		b[0] = byte(val)
+	case 2:
+		vm.Endianness.PutUint16(b, uint16(val))
+	case 4:
+		vm.Endianness.PutUint32(b, uint32(val))
+	default:
+		vm.Endianness.PutUint64(b, val)
+	}
+}
+
+// ldx builds an opFunc for "ldx{w,h,b,dw} dst, [src+off]".
+func ldx(size int) opFunc {
+	return func(vm *VM, instr *Instruction) error {
+		src, dst := vm.getSrc(instr), vm.getDst(instr)
+		addr := uint64(int64(vm.getRegister(src)) + int64(instr.Offset))
+		b, err := vm.translate(addr, uint64(size), false)
+		if err != nil {
+			return err
+		}
+		vm.setRegister(dst, readSize(vm, b, size))
+		return nil
+	}
+}
+
+// stx builds an opFunc for "stx{w,h,b,dw} [dst+off], src".
+func stx(size int) opFunc {
+	return func(vm *VM, instr *Instruction) error {
+		src, dst := vm.getSrc(instr), vm.getDst(instr)
+		addr := uint64(int64(vm.getRegister(dst)) + int64(instr.Offset))
+		b, err := vm.translate(addr, uint64(size), true)
+		if err != nil {
+			return err
+		}
+		writeSize(vm, b, size, vm.getRegister(src))
+		return nil
+	}
+}
+
+// st builds an opFunc for "st{w,h,b,dw} [dst+off], imm".
+func st(size int) opFunc {
+	return func(vm *VM, instr *Instruction) error {
+		dst := vm.getDst(instr)
+		addr := uint64(int64(vm.getRegister(dst)) + int64(instr.Offset))
+		b, err := vm.translate(addr, uint64(size), true)
+		if err != nil {
+			return err
+		}
+		writeSize(vm, b, size, signExtendImmediate(instr.Immediate))
+		return nil
+	}
+}
+
+// lddw implements the two-word "lddw dst, imm64" pseudo-instruction: the
+// low 32 bits come from this instruction's immediate, the high 32 bits from
+// the immediate of the zeroed instruction word immediately following it in
+// the program region.
+func lddw(vm *VM, instr *Instruction) error {
+	dst := vm.getDst(instr)
+	addr := vm.Memory.Program.VA + uint64(vm.PC)*InstructionSize
+	b, err := vm.translate(addr, InstructionSize, false)
+	if err != nil {
+		return err
+	}
+
+	hi := vm.Endianness.Uint32(b[4:8])
+	vm.setRegister(dst, uint64(hi)<<32|uint64(uint32(instr.Immediate)))
+	vm.PC++
+	return nil
+}
+
+// ldabs builds an opFunc for the classic-BPF-style "ldabs{w,h,b,dw} imm":
+// dst is always R0, and imm is an absolute offset into the input buffer.
+func ldabs(size int) opFunc {
+	return func(vm *VM, instr *Instruction) error {
+		addr := vm.Memory.Input.VA + uint64(uint32(instr.Immediate))
+		b, err := vm.translate(addr, uint64(size), false)
+		if err != nil {
+			return err
+		}
+		vm.setRegister(0, readSize(vm, b, size))
+		return nil
+	}
+}
+
+// ldind builds an opFunc for "ldind{w,h,b,dw} src, imm": like ldabs, but
+// the offset into the input buffer is src's value plus imm.
+func ldind(size int) opFunc {
+	return func(vm *VM, instr *Instruction) error {
+		src := vm.getSrc(instr)
+		addr := vm.Memory.Input.VA + vm.getRegister(src) + uint64(uint32(instr.Immediate))
+		b, err := vm.translate(addr, uint64(size), false)
+		if err != nil {
+			return err
+		}
+		vm.setRegister(0, readSize(vm, b, size))
+		return nil
+	}
+}
+
+func init() {
+	registerOpcodes(map[uint8]opFunc{
+		OpcodeLDXW:  ldx(4),
+		OpcodeLDXH:  ldx(2),
+		OpcodeLDXB:  ldx(1),
+		OpcodeLDXDW: ldx(8),
+
+		OpcodeSTXW:  stx(4),
+		OpcodeSTXH:  stx(2),
+		OpcodeSTXB:  stx(1),
+		OpcodeSTXDW: stx(8),
+
+		OpcodeSTW:  st(4),
+		OpcodeSTH:  st(2),
+		OpcodeSTB:  st(1),
+		OpcodeSTDW: st(8),
+
+		OpcodeLDDW: lddw,
+
+		OpcodeLDABSW:  ldabs(4),
+		OpcodeLDABSH:  ldabs(2),
+		OpcodeLDABSB:  ldabs(1),
+		OpcodeLDABSDW: ldabs(8),
+
+		OpcodeLDINDW:  ldind(4),
+		OpcodeLDINDH:  ldind(2),
+		OpcodeLDINDB:  ldind(1),
+		OpcodeLDINDDW: ldind(8),
+	})
+}
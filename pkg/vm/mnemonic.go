@@ -0,0 +1,278 @@
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// OperandForm describes the operand shape associated with a Mnemonic. It is
+// shared between VM.Disassemble and pkg/asm, so both agree on how an
+// instruction is written and read back.
+type OperandForm int
+
+const (
+	FormAluImm  OperandForm = iota // <mnemonic> dst, imm
+	FormAluReg                     // <mnemonic> dst, src
+	FormUnary                      // <mnemonic> dst
+	FormEndian                     // le16/le32/le64/be16/be32/be64 dst
+	FormJumpImm                    // <mnemonic> dst, imm, +off
+	FormJumpReg                    // <mnemonic> dst, src, +off
+	FormJA                         // ja +off
+	FormCall                       // call imm
+	FormExit                       // exit
+	FormLDDW                       // lddw dst, imm64
+	FormLDX                        // <mnemonic> dst, [src+off]
+	FormSTX                        // <mnemonic> [dst+off], src
+	FormST                         // <mnemonic> [dst+off], imm
+	FormLDABS                      // <mnemonic> imm
+	FormLDIND                      // <mnemonic> src, imm
+)
+
+// Mnemonic is one entry of the assembly dialect this VM understands: a name
+// together with enough of the opcode space to both assemble and
+// disassemble it. Imm is the opcode for the K (immediate) form, or the only
+// opcode for mnemonics that don't have a register form; Reg is the X
+// (register) form's opcode, zero if there isn't one.
+type Mnemonic struct {
+	Name string
+	Form OperandForm
+	Imm  uint8
+	Reg  uint8
+}
+
+// Mnemonics is the full eBPF assembly dialect, indexed by name.
+var Mnemonics = buildMnemonics()
+
+// opcodeEntry is one direction of the opcode -> Mnemonic reverse lookup
+// Format uses; isReg records whether this opcode is the mnemonic's X form.
+type opcodeEntry struct {
+	mnemonic Mnemonic
+	isReg    bool
+}
+
+var byOpcode = buildByOpcode()
+
+type aluOrJumpOp struct {
+	name     string
+	imm, reg uint8
+}
+
+func buildMnemonics() map[string]Mnemonic {
+	m := map[string]Mnemonic{}
+	add := func(mn Mnemonic) { m[mn.Name] = mn }
+
+	alu := []aluOrJumpOp{
+		{"add", OpcodeADDIMM, OpcodeADDSRC},
+		{"sub", OpcodeSUBIMM, OpcodeSUBSRC},
+		{"mul", OpcodeMULIMM, OpcodeMULSRC},
+		{"div", OpcodeDIVIMM, OpcodeDIVSRC},
+		{"or", OpcodeORIMM, OpcodeORSRC},
+		{"and", OpcodeANDIMM, OpcodeANDSRC},
+		{"lsh", OpcodeLSHIMM, OpcodeLSHSRC},
+		{"rsh", OpcodeRSHIMM, OpcodeRSHSRC},
+		{"mod", OpcodeMODIMM, OpcodeMODSRC},
+		{"xor", OpcodeXORIMM, OpcodeXORSRC},
+		{"mov", OpcodeMOVDSTIMM, OpcodeMOVDSTSRC},
+		{"arsh", OpcodeARSHIMM, OpcodeARSHSRC},
+	}
+	alu32 := []aluOrJumpOp{
+		{"add32", OpcodeADD32IMM, OpcodeADD32SRC},
+		{"sub32", OpcodeSUB32IMM, OpcodeSUB32SRC},
+		{"mul32", OpcodeMUL32IMM, OpcodeMUL32SRC},
+		{"div32", OpcodeDIV32IMM, OpcodeDIV32SRC},
+		{"or32", OpcodeOR32IMM, OpcodeOR32SRC},
+		{"and32", OpcodeAND32IMM, OpcodeAND32SRC},
+		{"lsh32", OpcodeLSH32IMM, OpcodeLSH32SRC},
+		{"rsh32", OpcodeRSH32IMM, OpcodeRSH32SRC},
+		{"mod32", OpcodeMOD32IMM, OpcodeMOD32SRC},
+		{"xor32", OpcodeXOR32IMM, OpcodeXOR32SRC},
+		{"mov32", OpcodeMOV32DSTIMM, OpcodeMOV32DSTSRC},
+		{"arsh32", OpcodeARSH32IMM, OpcodeARSH32SRC},
+	}
+	for _, e := range append(alu, alu32...) {
+		add(Mnemonic{Name: e.name, Form: FormAluImm, Imm: e.imm, Reg: e.reg})
+	}
+
+	add(Mnemonic{Name: "neg", Form: FormUnary, Imm: OpcodeNEG})
+	add(Mnemonic{Name: "neg32", Form: FormUnary, Imm: OpcodeNEG32})
+
+	for _, width := range []int{16, 32, 64} {
+		add(Mnemonic{Name: fmt.Sprintf("le%d", width), Form: FormEndian, Imm: OpcodeLE})
+		add(Mnemonic{Name: fmt.Sprintf("be%d", width), Form: FormEndian, Imm: OpcodeBE})
+	}
+
+	jmp := []aluOrJumpOp{
+		{"jeq", OpcodeJEQIMM, OpcodeJEQSRC},
+		{"jgt", OpcodeJGTIMM, OpcodeJGTSRC},
+		{"jge", OpcodeJGEIMM, OpcodeJGESRC},
+		{"jset", OpcodeJSETIMM, OpcodeJSETSRC},
+		{"jne", OpcodeJNEIMM, OpcodeJNESRC},
+		{"jsgt", OpcodeJSGTIMM, OpcodeJSGTSRC},
+		{"jsge", OpcodeJSGEIMM, OpcodeJSGESRC},
+		{"jlt", OpcodeJLTIMM, OpcodeJLTSRC},
+		{"jle", OpcodeJLEIMM, OpcodeJLESRC},
+		{"jslt", OpcodeJSLTIMM, OpcodeJSLTSRC},
+		{"jsle", OpcodeJSLEIMM, OpcodeJSLESRC},
+	}
+	jmp32 := []aluOrJumpOp{
+		{"jeq32", OpcodeJEQ32IMM, OpcodeJEQ32SRC},
+		{"jgt32", OpcodeJGT32IMM, OpcodeJGT32SRC},
+		{"jge32", OpcodeJGE32IMM, OpcodeJGE32SRC},
+		{"jset32", OpcodeJSET32IMM, OpcodeJSET32SRC},
+		{"jne32", OpcodeJNE32IMM, OpcodeJNE32SRC},
+		{"jsgt32", OpcodeJSGT32IMM, OpcodeJSGT32SRC},
+		{"jsge32", OpcodeJSGE32IMM, OpcodeJSGE32SRC},
+		{"jlt32", OpcodeJLT32IMM, OpcodeJLT32SRC},
+		{"jle32", OpcodeJLE32IMM, OpcodeJLE32SRC},
+		{"jslt32", OpcodeJSLT32IMM, OpcodeJSLT32SRC},
+		{"jsle32", OpcodeJSLE32IMM, OpcodeJSLE32SRC},
+	}
+	for _, e := range append(jmp, jmp32...) {
+		add(Mnemonic{Name: e.name, Form: FormJumpImm, Imm: e.imm, Reg: e.reg})
+	}
+
+	add(Mnemonic{Name: "ja", Form: FormJA, Imm: OpcodeJA})
+	add(Mnemonic{Name: "call", Form: FormCall, Imm: OpcodeCALL})
+	add(Mnemonic{Name: "exit", Form: FormExit, Imm: OpcodeEXIT})
+	add(Mnemonic{Name: "lddw", Form: FormLDDW, Imm: OpcodeLDDW})
+
+	type memOp struct {
+		name string
+		op   uint8
+	}
+	for _, e := range []memOp{
+		{"ldxw", OpcodeLDXW}, {"ldxh", OpcodeLDXH}, {"ldxb", OpcodeLDXB}, {"ldxdw", OpcodeLDXDW},
+	} {
+		add(Mnemonic{Name: e.name, Form: FormLDX, Imm: e.op})
+	}
+	for _, e := range []memOp{
+		{"stxw", OpcodeSTXW}, {"stxh", OpcodeSTXH}, {"stxb", OpcodeSTXB}, {"stxdw", OpcodeSTXDW},
+	} {
+		add(Mnemonic{Name: e.name, Form: FormSTX, Imm: e.op})
+	}
+	for _, e := range []memOp{
+		{"stw", OpcodeSTW}, {"sth", OpcodeSTH}, {"stb", OpcodeSTB}, {"stdw", OpcodeSTDW},
+	} {
+		add(Mnemonic{Name: e.name, Form: FormST, Imm: e.op})
+	}
+	for _, e := range []memOp{
+		{"ldabsw", OpcodeLDABSW}, {"ldabsh", OpcodeLDABSH}, {"ldabsb", OpcodeLDABSB}, {"ldabsdw", OpcodeLDABSDW},
+	} {
+		add(Mnemonic{Name: e.name, Form: FormLDABS, Imm: e.op})
+	}
+	for _, e := range []memOp{
+		{"ldindw", OpcodeLDINDW}, {"ldindh", OpcodeLDINDH}, {"ldindb", OpcodeLDINDB}, {"ldinddw", OpcodeLDINDDW},
+	} {
+		add(Mnemonic{Name: e.name, Form: FormLDIND, Imm: e.op})
+	}
+
+	return m
+}
+
+// buildByOpcode inverts Mnemonics for disassembly. FormEndian is excluded:
+// OpcodeLE/OpcodeBE are shared by three mnemonics each (le16/le32/le64 and
+// be16/be32/be64), disambiguated at disassembly time by instr.Immediate
+// rather than by opcode.
+func buildByOpcode() map[uint8]opcodeEntry {
+	out := map[uint8]opcodeEntry{}
+	for _, mn := range Mnemonics {
+		if mn.Form == FormEndian {
+			continue
+		}
+		out[mn.Imm] = opcodeEntry{mnemonic: mn}
+		if mn.Reg != 0 {
+			out[mn.Reg] = opcodeEntry{mnemonic: mn, isReg: true}
+		}
+	}
+	return out
+}
+
+// decodeDst and decodeSrc pull the destination/source register out of
+// DstSrc for a given byte order; VM.getDst/getSrc delegate to these so
+// Format (which has no VM to call a method on) can share the same logic.
+func decodeDst(i *Instruction, order binary.ByteOrder) uint8 {
+	if order == binary.LittleEndian {
+		return i.DstSrc & 0x0f
+	}
+	return i.DstSrc >> 4
+}
+
+func decodeSrc(i *Instruction, order binary.ByteOrder) uint8 {
+	if order == binary.LittleEndian {
+		return i.DstSrc >> 4
+	}
+	return i.DstSrc & 0x0f
+}
+
+// EncodeDstSrc packs dst and src into a DstSrc byte for the given byte
+// order; it is the inverse of decodeDst/decodeSrc, exported for pkg/asm's
+// assembler.
+func EncodeDstSrc(dst, src uint8, order binary.ByteOrder) uint8 {
+	if order == binary.LittleEndian {
+		return src<<4 | dst
+	}
+	return dst<<4 | src
+}
+
+// Format renders a single decoded instruction in the textual form
+// pkg/asm's assembler accepts. next is only consulted for lddw, to
+// reconstruct its 64-bit immediate from the following (pseudo-)
+// instruction word; pass nil when it isn't available.
+func Format(i *Instruction, next *Instruction, order binary.ByteOrder) string {
+	dst := decodeDst(i, order)
+	src := decodeSrc(i, order)
+
+	if i.Opcode == OpcodeLE || i.Opcode == OpcodeBE {
+		name := "le"
+		if i.Opcode == OpcodeBE {
+			name = "be"
+		}
+		return fmt.Sprintf("%s%d r%d", name, i.Immediate, dst)
+	}
+
+	entry, ok := byOpcode[i.Opcode]
+	if !ok {
+		return fmt.Sprintf("todo (%#x)", i.Opcode)
+	}
+	mn := entry.mnemonic
+
+	switch mn.Form {
+	case FormAluImm:
+		if entry.isReg {
+			return fmt.Sprintf("%-6s r%d, r%d", mn.Name, dst, src)
+		}
+		return fmt.Sprintf("%-6s r%d, %d", mn.Name, dst, i.Immediate)
+	case FormUnary:
+		return fmt.Sprintf("%-6s r%d", mn.Name, dst)
+	case FormJumpImm:
+		if entry.isReg {
+			return fmt.Sprintf("%-6s r%d, r%d, %+d", mn.Name, dst, src, i.Offset)
+		}
+		return fmt.Sprintf("%-6s r%d, %d, %+d", mn.Name, dst, i.Immediate, i.Offset)
+	case FormJA:
+		return fmt.Sprintf("%-6s %+d", mn.Name, i.Offset)
+	case FormCall:
+		return fmt.Sprintf("%-6s %d", mn.Name, i.Immediate)
+	case FormExit:
+		return "exit"
+	case FormLDDW:
+		var hi uint32
+		if next != nil {
+			hi = uint32(next.Immediate)
+		}
+		val := uint64(hi)<<32 | uint64(uint32(i.Immediate))
+		return fmt.Sprintf("%-6s r%d, %#x", mn.Name, dst, val)
+	case FormLDX:
+		return fmt.Sprintf("%-6s r%d, [r%d%+d]", mn.Name, dst, src, i.Offset)
+	case FormSTX:
+		return fmt.Sprintf("%-6s [r%d%+d], r%d", mn.Name, dst, i.Offset, src)
+	case FormST:
+		return fmt.Sprintf("%-6s [r%d%+d], %d", mn.Name, dst, i.Offset, i.Immediate)
+	case FormLDABS:
+		return fmt.Sprintf("%-6s %d", mn.Name, i.Immediate)
+	case FormLDIND:
+		return fmt.Sprintf("%-6s r%d, %d", mn.Name, src, i.Immediate)
+	default:
+		return fmt.Sprintf("todo (%#x)", i.Opcode)
+	}
+}
@@ -0,0 +1,230 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// VerifyError is one finding from Verify. Error() includes the offending
+// instruction's index so a caller can report a single actionable list
+// instead of failing mid-run.
+type VerifyError struct {
+	PC  int
+	Msg string
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("vm: verify: pc %d: %s", e.PC, e.Msg)
+}
+
+// regState is the abstract value tracked for each register by Verify's
+// lightweight sweep: just enough to flag obviously uninitialized reads,
+// not a full type system.
+type regState int
+
+const (
+	regUnknown regState = iota
+	regScalar
+	regStackPointer
+)
+
+// isBranchOpcode reports whether opcode is a PC-relative branch: JA or any
+// JMP/JMP32 conditional. CALL and EXIT share the JMP class but don't branch
+// via instr.Offset, so they're excluded.
+func isBranchOpcode(opcode uint8) bool {
+	class := opcode & 0x07
+	if class != BPFJMP && class != BPFJMP32 {
+		return false
+	}
+	return opcode != OpcodeCALL && opcode != OpcodeEXIT
+}
+
+// writesDst reports whether opcode writes its decoded dst register
+// (as opposed to e.g. STX/ST, which write memory, or LDABS/LDIND, which
+// always target the fixed R0).
+func writesDst(opcode uint8) bool {
+	class := opcode & 0x07
+	return class == BPFALU || class == BPFALU64 || class == BPFLDX || opcode == OpcodeLDDW
+}
+
+// successors returns the indices Verify's reachability sweep should visit
+// after instruction i, treating OpcodeLDDW as the two-word instruction it
+// is and EXIT as a dead end.
+func successors(program []Instruction, i int) []int {
+	instr := program[i]
+	switch {
+	case instr.Opcode == OpcodeEXIT:
+		return nil
+	case instr.Opcode == OpcodeLDDW:
+		return []int{i + 2}
+	case instr.Opcode == OpcodeJA:
+		return []int{i + 1 + int(instr.Offset)}
+	case isBranchOpcode(instr.Opcode):
+		return []int{i + 1, i + 1 + int(instr.Offset)}
+	default:
+		return []int{i + 1}
+	}
+}
+
+// Verify statically checks program before it is ever fetched/executed,
+// rejecting the mistakes the kernel's eBPF verifier and rbpf's static
+// checks catch: out-of-bounds or mid-LDDW jump targets, invalid register
+// indices, writes to R10, CALL immediates that don't resolve to a
+// registered helper, unreachable EXIT, and division/modulo by a literal
+// zero. It also runs a lightweight abstract-interpretation sweep over
+// register state (known scalar / stack pointer / unknown) to flag reads of
+// registers no prior instruction could have initialized.
+//
+// Verify reports every problem it finds rather than stopping at the first
+// one, joined into a single error via errors.Join.
+func (vm *VM) Verify(program []Instruction) error {
+	var issues []error
+	report := func(pc int, format string, args ...any) {
+		issues = append(issues, &VerifyError{PC: pc, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	secondWord := make([]bool, len(program))
+	for i, instr := range program {
+		if instr.Opcode == OpcodeLDDW && i+1 < len(program) {
+			secondWord[i+1] = true
+		}
+	}
+
+	states := [NumRegisters]regState{}
+	states[1] = regScalar
+	states[10] = regStackPointer
+
+	for i := 0; i < len(program); i++ {
+		instr := program[i]
+		dst, src := vm.getDst(&instr), vm.getSrc(&instr)
+
+		if dst >= NumRegisters {
+			report(i, "invalid destination register r%d", dst)
+		}
+		if src >= NumRegisters {
+			report(i, "invalid source register r%d", src)
+		}
+
+		if writesDst(instr.Opcode) && dst == 10 {
+			report(i, "write to r10 (frame pointer) is not allowed")
+		}
+
+		if isBranchOpcode(instr.Opcode) {
+			target := i + 1 + int(instr.Offset)
+			if target < 0 || target >= len(program) {
+				report(i, "jump target %d is out of bounds", target)
+			} else if secondWord[target] {
+				report(i, "jump target %d lands on the second word of an lddw", target)
+			}
+		}
+
+		switch instr.Opcode {
+		case OpcodeDIVIMM, OpcodeMODIMM, OpcodeDIV32IMM, OpcodeMOD32IMM:
+			if instr.Immediate == 0 {
+				report(i, "division or modulo by a literal zero")
+			}
+		case OpcodeCALL:
+			if _, ok := vm.syscalls[uint32(instr.Immediate)]; !ok {
+				report(i, "call references unregistered helper %d", instr.Immediate)
+			}
+		}
+
+		// Abstract-interpretation sweep: flag reads of registers no
+		// instruction so far could have initialized. src is checked for
+		// X-form ALU/JMP, LDX/STX and LDIND; dst is checked only as the
+		// base address of ST/STX. Reads of dst by ALU and JMP
+		// instructions are not checked, and reads of r0 as src are
+		// never flagged.
+		var readsSrc bool
+		switch instr.Opcode & 0x07 {
+		case BPFALU, BPFALU64, BPFJMP, BPFJMP32:
+			readsSrc = instr.Opcode&BPFX == BPFX // bit only means X-form for these classes
+		case BPFLDX, BPFSTX:
+			readsSrc = true
+		case BPFLD:
+			readsSrc = instr.Opcode == OpcodeLDINDW || instr.Opcode == OpcodeLDINDH ||
+				instr.Opcode == OpcodeLDINDB || instr.Opcode == OpcodeLDINDDW
+		}
+		if readsSrc && src < NumRegisters && states[src] == regUnknown && src != 0 {
+			report(i, "read from r%d before it is ever written", src)
+		}
+		if (instr.Opcode&0x07 == BPFSTX || instr.Opcode&0x07 == BPFST) &&
+			dst < NumRegisters && states[dst] == regUnknown {
+			report(i, "memory access through r%d before it is ever written", dst)
+		}
+
+		switch {
+		case instr.Opcode == OpcodeCALL:
+			// R0 receives the result; R1-R5 are caller-saved and must be
+			// treated as clobbered once the call returns.
+			states[0] = regScalar
+			states[1], states[2], states[3], states[4], states[5] =
+				regUnknown, regUnknown, regUnknown, regUnknown, regUnknown
+		case writesDst(instr.Opcode) && dst < NumRegisters:
+			states[dst] = nextState(instr, states, dst, src)
+		}
+	}
+
+	if reachable := reachableExit(program); !reachable {
+		issues = append(issues, &VerifyError{PC: 0, Msg: "no EXIT instruction is reachable from entry"})
+	}
+
+	return errors.Join(issues...)
+}
+
+// nextState computes the abstract state dst holds after instr executes,
+// given the states before it. Only MOV and ALU64 ADD/SUB of an immediate on
+// an existing stack pointer preserve pointer-ness (the common "mov r2, r10; add r2,
+// -8" stack-addressing idiom); every other ALU result is just a scalar.
+func nextState(instr Instruction, states [NumRegisters]regState, dst, src uint8) regState {
+	switch instr.Opcode {
+	case OpcodeMOVDSTSRC, OpcodeMOV32DSTSRC:
+		if src < NumRegisters {
+			return states[src]
+		}
+		return regUnknown
+	case OpcodeMOVDSTIMM, OpcodeMOV32DSTIMM:
+		return regScalar
+	case OpcodeADDIMM, OpcodeSUBIMM:
+		if states[dst] == regStackPointer {
+			return regStackPointer
+		}
+		return regScalar
+	default:
+		if writesDst(instr.Opcode) {
+			return regScalar
+		}
+		return states[dst]
+	}
+}
+
+// reachableExit reports whether any EXIT instruction is reachable from
+// program entry by a BFS over successors.
+func reachableExit(program []Instruction) bool {
+	if len(program) == 0 {
+		return false
+	}
+
+	visited := make([]bool, len(program))
+	queue := []int{0}
+	visited[0] = true
+
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+
+		if program[i].Opcode == OpcodeEXIT {
+			return true
+		}
+
+		for _, next := range successors(program, i) {
+			if next < 0 || next >= len(program) || visited[next] {
+				continue
+			}
+			visited[next] = true
+			queue = append(queue, next)
+		}
+	}
+
+	return false
+}
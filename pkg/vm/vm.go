@@ -1,6 +1,8 @@
 package vm
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -89,25 +91,66 @@ const (
 	BPFXADD = 0xc0 /* eBPF only, exclusive add */
 
 	// ***********************
-	//  ALU instructions
+	//  ALU64 instructions
 	// ***********************
 	OpcodeADDIMM = BPFALU64 | BPFADD | BPFK // 0x07
 	OpcodeADDSRC = BPFALU64 | BPFADD | BPFX // 0x0f
 	OpcodeSUBIMM = BPFALU64 | BPFSUB | BPFK // 0x17
 	OpcodeSUBSRC = BPFALU64 | BPFSUB | BPFX // 0x1f
-
-	// TODO: a bunch of instructions.
+	OpcodeMULIMM = BPFALU64 | BPFMUL | BPFK // 0x27
+	OpcodeMULSRC = BPFALU64 | BPFMUL | BPFX // 0x2f
+	OpcodeDIVIMM = BPFALU64 | BPFDIV | BPFK // 0x37
+	OpcodeDIVSRC = BPFALU64 | BPFDIV | BPFX // 0x3f
+	OpcodeORIMM  = BPFALU64 | BPFOR | BPFK  // 0x47
+	OpcodeORSRC  = BPFALU64 | BPFOR | BPFX  // 0x4f
+	OpcodeANDIMM = BPFALU64 | BPFAND | BPFK // 0x57
+	OpcodeANDSRC = BPFALU64 | BPFAND | BPFX // 0x5f
 
 	OpcodeLSHIMM  = BPFALU64 | BPFLSH | BPFK  // 0x67
 	OpcodeLSHSRC  = BPFALU64 | BPFLSH | BPFX  // 0x6f
 	OpcodeRSHIMM  = BPFALU64 | BPFRSH | BPFK  // 0x77
 	OpcodeRSHSRC  = BPFALU64 | BPFRSH | BPFX  // 0x7f
+	OpcodeNEG     = BPFALU64 | BPFNEG | BPFK  // 0x87
+	OpcodeMODIMM  = BPFALU64 | BPFMOD | BPFK  // 0x97
+	OpcodeMODSRC  = BPFALU64 | BPFMOD | BPFX  // 0x9f
+	OpcodeXORIMM  = BPFALU64 | BPFXOR | BPFK  // 0xa7
+	OpcodeXORSRC  = BPFALU64 | BPFXOR | BPFX  // 0xaf
 	OpcodeARSHIMM = BPFALU64 | BPFARSH | BPFK // 0xc7
+	OpcodeARSHSRC = BPFALU64 | BPFARSH | BPFX // 0xcf
 
 	OpcodeMOVDSTIMM = BPFALU64 | BPFMOV | BPFK // 0xb7
 	OpcodeMOVDSTSRC = BPFALU64 | BPFMOV | BPFX // 0xbf
 
-	// TODO: 32-bit instructions.
+	// ***********************
+	//  ALU32 instructions
+	// ***********************
+	OpcodeADD32IMM = BPFALU | BPFADD | BPFK // 0x04
+	OpcodeADD32SRC = BPFALU | BPFADD | BPFX // 0x0c
+	OpcodeSUB32IMM = BPFALU | BPFSUB | BPFK // 0x14
+	OpcodeSUB32SRC = BPFALU | BPFSUB | BPFX // 0x1c
+	OpcodeMUL32IMM = BPFALU | BPFMUL | BPFK // 0x24
+	OpcodeMUL32SRC = BPFALU | BPFMUL | BPFX // 0x2c
+	OpcodeDIV32IMM = BPFALU | BPFDIV | BPFK // 0x34
+	OpcodeDIV32SRC = BPFALU | BPFDIV | BPFX // 0x3c
+	OpcodeOR32IMM  = BPFALU | BPFOR | BPFK  // 0x44
+	OpcodeOR32SRC  = BPFALU | BPFOR | BPFX  // 0x4c
+	OpcodeAND32IMM = BPFALU | BPFAND | BPFK // 0x54
+	OpcodeAND32SRC = BPFALU | BPFAND | BPFX // 0x5c
+
+	OpcodeLSH32IMM  = BPFALU | BPFLSH | BPFK  // 0x64
+	OpcodeLSH32SRC  = BPFALU | BPFLSH | BPFX  // 0x6c
+	OpcodeRSH32IMM  = BPFALU | BPFRSH | BPFK  // 0x74
+	OpcodeRSH32SRC  = BPFALU | BPFRSH | BPFX  // 0x7c
+	OpcodeNEG32     = BPFALU | BPFNEG | BPFK  // 0x84
+	OpcodeMOD32IMM  = BPFALU | BPFMOD | BPFK  // 0x94
+	OpcodeMOD32SRC  = BPFALU | BPFMOD | BPFX  // 0x9c
+	OpcodeXOR32IMM  = BPFALU | BPFXOR | BPFK  // 0xa4
+	OpcodeXOR32SRC  = BPFALU | BPFXOR | BPFX  // 0xac
+	OpcodeARSH32IMM = BPFALU | BPFARSH | BPFK // 0xc4
+	OpcodeARSH32SRC = BPFALU | BPFARSH | BPFX // 0xcc
+
+	OpcodeMOV32DSTIMM = BPFALU | BPFMOV | BPFK // 0xb4
+	OpcodeMOV32DSTSRC = BPFALU | BPFMOV | BPFX // 0xbc
 
 	// ***********************
 	// Byteswap instructions
@@ -157,13 +200,61 @@ const (
 	OpcodeSTXDW = BPFSTX | BPFDW | BPFMEM // 0x7b
 
 	// ***********************
-	// Branch instructions
+	// Branch instructions (BPF_JMP, 64-bit comparisons)
 	// ***********************
-
-	// TODO: branch instructions.
+	OpcodeJA      = BPFJMP | BPFJA          // 0x05
+	OpcodeJEQIMM  = BPFJMP | BPFJEQ | BPFK  // 0x15
+	OpcodeJEQSRC  = BPFJMP | BPFJEQ | BPFX  // 0x1d
+	OpcodeJGTIMM  = BPFJMP | BPFJGT | BPFK  // 0x25
+	OpcodeJGTSRC  = BPFJMP | BPFJGT | BPFX  // 0x2d
+	OpcodeJGEIMM  = BPFJMP | BPFJGE | BPFK  // 0x35
+	OpcodeJGESRC  = BPFJMP | BPFJGE | BPFX  // 0x3d
+	OpcodeJSETIMM = BPFJMP | BPFJSET | BPFK // 0x45
+	OpcodeJSETSRC = BPFJMP | BPFJSET | BPFX // 0x4d
+	OpcodeJNEIMM  = BPFJMP | BPFJNE | BPFK  // 0x55
+	OpcodeJNESRC  = BPFJMP | BPFJNE | BPFX  // 0x5d
+	OpcodeJSGTIMM = BPFJMP | BPFJSGT | BPFK // 0x65
+	OpcodeJSGTSRC = BPFJMP | BPFJSGT | BPFX // 0x6d
+	OpcodeJSGEIMM = BPFJMP | BPFJSGE | BPFK // 0x75
+	OpcodeJSGESRC = BPFJMP | BPFJSGE | BPFX // 0x7d
 
 	OpcodeCALL = 0x85
 	OpcodeEXIT = 0x95
+
+	OpcodeJLTIMM  = BPFJMP | BPFJLT | BPFK  // 0xa5
+	OpcodeJLTSRC  = BPFJMP | BPFJLT | BPFX  // 0xad
+	OpcodeJLEIMM  = BPFJMP | BPFJLE | BPFK  // 0xb5
+	OpcodeJLESRC  = BPFJMP | BPFJLE | BPFX  // 0xbd
+	OpcodeJSLTIMM = BPFJMP | BPFJSLT | BPFK // 0xc5
+	OpcodeJSLTSRC = BPFJMP | BPFJSLT | BPFX // 0xcd
+	OpcodeJSLEIMM = BPFJMP | BPFJSLE | BPFK // 0xd5
+	OpcodeJSLESRC = BPFJMP | BPFJSLE | BPFX // 0xdd
+
+	// ***********************
+	// Branch instructions (BPF_JMP32, 32-bit comparisons)
+	// ***********************
+	OpcodeJEQ32IMM  = BPFJMP32 | BPFJEQ | BPFK  // 0x16
+	OpcodeJEQ32SRC  = BPFJMP32 | BPFJEQ | BPFX  // 0x1e
+	OpcodeJGT32IMM  = BPFJMP32 | BPFJGT | BPFK  // 0x26
+	OpcodeJGT32SRC  = BPFJMP32 | BPFJGT | BPFX  // 0x2e
+	OpcodeJGE32IMM  = BPFJMP32 | BPFJGE | BPFK  // 0x36
+	OpcodeJGE32SRC  = BPFJMP32 | BPFJGE | BPFX  // 0x3e
+	OpcodeJSET32IMM = BPFJMP32 | BPFJSET | BPFK // 0x46
+	OpcodeJSET32SRC = BPFJMP32 | BPFJSET | BPFX // 0x4e
+	OpcodeJNE32IMM  = BPFJMP32 | BPFJNE | BPFK  // 0x56
+	OpcodeJNE32SRC  = BPFJMP32 | BPFJNE | BPFX  // 0x5e
+	OpcodeJSGT32IMM = BPFJMP32 | BPFJSGT | BPFK // 0x66
+	OpcodeJSGT32SRC = BPFJMP32 | BPFJSGT | BPFX // 0x6e
+	OpcodeJSGE32IMM = BPFJMP32 | BPFJSGE | BPFK // 0x76
+	OpcodeJSGE32SRC = BPFJMP32 | BPFJSGE | BPFX // 0x7e
+	OpcodeJLT32IMM  = BPFJMP32 | BPFJLT | BPFK  // 0xa6
+	OpcodeJLT32SRC  = BPFJMP32 | BPFJLT | BPFX  // 0xae
+	OpcodeJLE32IMM  = BPFJMP32 | BPFJLE | BPFK  // 0xb6
+	OpcodeJLE32SRC  = BPFJMP32 | BPFJLE | BPFX  // 0xbe
+	OpcodeJSLT32IMM = BPFJMP32 | BPFJSLT | BPFK // 0xc6
+	OpcodeJSLT32SRC = BPFJMP32 | BPFJSLT | BPFX // 0xce
+	OpcodeJSLE32IMM = BPFJMP32 | BPFJSLE | BPFK // 0xd6
+	OpcodeJSLE32SRC = BPFJMP32 | BPFJSLE | BPFX // 0xde
 )
 
 // Word is a 64-bit word.
@@ -173,117 +264,170 @@ type Word uint64
 type VM struct {
 	Endianness binary.ByteOrder
 	GPR        [NumRegisters]uint64 // general purpose registers + frame pointer
-	Stack      [StackSize]uint8     // stack
-	Program    io.Reader            // instructions
-	PC         int                  // program counter
+	Memory     *MemoryMapping       // program/rodata, stack, heap and input regions
+	PC         int                  // program counter, in instructions
+
+	// Tracer, if set, is notified after every instruction Execute runs.
+	Tracer Tracer
+
+	// MaxInstructions bounds the number of instructions Fetch will hand
+	// out, the compute-unit budget sbpf uses to keep an untrusted program
+	// from running forever. Zero means unlimited.
+	MaxInstructions int
+
+	syscalls        map[uint32]Syscall // registered helpers, keyed by instr.Immediate
+	pendingWrites   []pendingWrite     // memory writes observed since the last Execute, for Tracer
+	instructionsRun int                // instructions Fetch has handed out so far, counted against MaxInstructions
 }
 
-// Load sets the vm.Program to the specified reader and
-// initializes the R10 register to the top of the stack.
-func (vm *VM) Load(section io.Reader) {
-	vm.Program = section
-	vm.GPR[10] = StackSize
+// ErrComputeExceeded is returned by Fetch (and so by Run) once
+// MaxInstructions instructions have been fetched without the program
+// reaching EXIT.
+var ErrComputeExceeded = errors.New("vm: compute unit budget exceeded")
+
+// Load reads the whole program into the program/rodata region, and
+// initializes R1 to the input region's VA and R10 to the top of the stack
+// region.
+func (vm *VM) Load(section io.Reader) error {
+	program, err := io.ReadAll(section)
+	if err != nil {
+		return err
+	}
+
+	vm.Memory = NewMemoryMapping(program, StackSize, DefaultHeapSize, nil)
+	vm.GPR[1] = vm.Memory.Input.VA
+	vm.GPR[10] = vm.Memory.Stack.VA + uint64(len(vm.Memory.Stack.Data))
+	vm.PC = 0
+	return nil
 }
 
-// Fetch reads an Instruction from the vm.Program reader.
+// Fetch reads the Instruction at the current PC from the program region.
+// It returns ErrComputeExceeded once MaxInstructions instructions have been
+// fetched, if MaxInstructions is set.
 func (vm *VM) Fetch() (*Instruction, error) {
-	var instr Instruction
-	err := binary.Read(vm.Program, vm.Endianness, &instr)
+	if vm.MaxInstructions > 0 && vm.instructionsRun >= vm.MaxInstructions {
+		return nil, ErrComputeExceeded
+	}
+	vm.instructionsRun++
+
+	addr := vm.Memory.Program.VA + uint64(vm.PC)*InstructionSize
+	b, err := vm.translate(addr, InstructionSize, false)
 	if err != nil {
 		return nil, err
 	}
 
-	// TODO: Handle multi-word instructions.
+	var instr Instruction
+	if err := binary.Read(bytes.NewReader(b), vm.Endianness, &instr); err != nil {
+		return nil, err
+	}
 
 	vm.PC++
 	return &instr, nil
 }
 
-func (vm *VM) store(data []byte, addr uint64) {
+// opFunc executes a single decoded instruction against vm. Jumps update
+// vm.PC directly (relative to the instruction following the branch, since
+// Fetch has already advanced the PC past it), and lddw advances it past its
+// second word; everything else just mutates registers or memory.
+type opFunc func(vm *VM, instr *Instruction) error
+
+// opcodeHandlers is the dispatch table Execute consults: adding support for
+// a new opcode is a matter of registering one more entry, typically from an
+// init() in the file that implements it (see alu.go, jump.go).
+var opcodeHandlers = map[uint8]opFunc{}
+
+// registerOpcodes merges handlers into opcodeHandlers. It panics on a
+// duplicate registration, since that would silently shadow one opcode's
+// implementation with another's.
+func registerOpcodes(handlers map[uint8]opFunc) {
+	for opcode, fn := range handlers {
+		if _, ok := opcodeHandlers[opcode]; ok {
+			panic(fmt.Sprintf("vm: opcode %#x registered twice", opcode))
+		}
+		opcodeHandlers[opcode] = fn
+	}
+}
+
+func init() {
+	registerOpcodes(map[uint8]opFunc{
+		OpcodeEXIT: func(vm *VM, instr *Instruction) error {
+			return errExit
+		},
+	})
 }
 
+// errExit is returned by Execute when the program hits an EXIT instruction.
+var errExit = errors.New("exit")
+
+// Execute runs a single decoded instruction by looking up its opcode in
+// opcodeHandlers. If vm.Tracer is set, it reports the instruction's
+// before/after register state and any memory writes it performed.
 func (vm *VM) Execute(instr *Instruction) error {
-	src := vm.getSrc(instr)
-	dst := vm.getDst(instr)
-
-	switch instr.Opcode {
-	case OpcodeEXIT:
-		return errors.New("exit")
-	case OpcodeSTXDW: // stxdw [dst+off], src
-		b := make([]byte, 8)
-		vm.Endianness.PutUint64(b, vm.getRegister(src))
-		addr := vm.getRegister(dst)
-		copy(vm.Stack[int64(addr)+int64(instr.Offset):], b)
-	case OpcodeSTXH: // stxh [dst+off], src
-		b := make([]byte, 2)
-		vm.Endianness.PutUint16(b, uint16(vm.getRegister(src)))
-		addr := vm.getRegister(dst)
-		copy(vm.Stack[int64(addr)+int64(instr.Offset):], b)
-	case OpcodeLDXH: // ldxh dst, [src+off]
-		start := int64(vm.getRegister(src)) + int64(instr.Offset)
-		value := vm.Endianness.Uint16(vm.Stack[start : start+2])
-		vm.setRegister(dst, uint64(value))
-	case OpcodeMOVDSTIMM: // mov dst, imm
-		vm.setRegister(dst, uint64(instr.Immediate))
-	case OpcodeLSHIMM: // lsh dst, imm
-		value := vm.getRegister(vm.getDst(instr))
-		vm.setRegister(dst, value<<instr.Immediate)
-	case OpcodeRSHIMM: // rsh dst, imm
-		value := vm.getRegister(vm.getDst(instr))
-		vm.setRegister(dst, value>>instr.Immediate)
-	case OpcodeARSHIMM: // arsh dst, imm
-		value := vm.getRegister(vm.getDst(instr))
-
-		// Using a signed int64 forces Go to do an arithmetic shift and keep
-		// the value's sign.
-		vm.setRegister(dst, uint64((int64(value) >> instr.Immediate)))
+	handler, ok := opcodeHandlers[instr.Opcode]
+	if !ok {
+		return fmt.Errorf("vm: unimplemented opcode %#x", instr.Opcode)
 	}
 
-	//vm.debug()
-	return nil
+	if vm.Tracer == nil {
+		return handler(vm, instr)
+	}
+
+	pc := vm.PC - 1 // Fetch already advanced PC past this instruction
+	regsBefore := vm.GPR
+	err := handler(vm, instr)
+	vm.Tracer.OnInstruction(pc, instr, regsBefore, vm.GPR, vm.collectStackDelta())
+	return err
+}
+
+// Run drives the fetch/execute loop until the program hits EXIT, ctx is
+// cancelled, or MaxInstructions is exhausted, checking both between every
+// instruction.
+func (vm *VM) Run(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		instr, err := vm.Fetch()
+		if err != nil {
+			return err
+		}
+
+		if err := vm.Execute(instr); err != nil {
+			if errors.Is(err, errExit) {
+				return nil
+			}
+			return err
+		}
+	}
 }
 
+// Disassemble prints the textual form of i, as produced by Format. For
+// OpcodeLDDW, which spans two instruction words, it peeks the following
+// word straight out of the program region to reconstruct the full 64-bit
+// immediate (Fetch has already advanced vm.PC to point at it).
 func (vm *VM) Disassemble(i *Instruction) {
-	switch i.Opcode {
-	case OpcodeSTXDW:
-		fmt.Printf("%-6s [r%d%+d], r%d\n", "stxdw", vm.getDst(i), i.Offset, vm.getSrc(i))
-	case OpcodeSTXH: // stxh [dst+off], src
-		fmt.Printf("%-6s [r%d%+d], r%d\n", "stxh", vm.getDst(i), i.Offset, vm.getSrc(i))
-	case OpcodeLDXH: // ldxh dst, [src+off]
-		fmt.Printf("%-6s r%d, [r%d%+d]\n", "ldxh", vm.getDst(i), vm.getSrc(i), i.Offset)
-	case OpcodeMOVDSTIMM:
-		fmt.Printf("%-6s r%d, %d\n", "mov", vm.getDst(i), i.Immediate)
-	case OpcodeLSHIMM:
-		fmt.Printf("%-6s r%d, %d\n", "lsh", vm.getDst(i), i.Immediate)
-	case OpcodeRSHIMM:
-		fmt.Printf("%-6s r%d, %d\n", "rsh", vm.getDst(i), i.Immediate)
-	case OpcodeARSHIMM:
-		fmt.Printf("%-6s r%d, %d\n", "arsh", vm.getDst(i), i.Immediate)
-	case OpcodeCALL:
-		fmt.Printf("%-6s %d\n", "call", i.Immediate)
-	case OpcodeEXIT:
-		fmt.Printf("exit\n")
-	default:
-		fmt.Printf("todo (%x)\n", i.Opcode)
+	var next *Instruction
+	if i.Opcode == OpcodeLDDW {
+		addr := vm.Memory.Program.VA + uint64(vm.PC)*InstructionSize
+		if b, err := vm.translate(addr, InstructionSize, false); err == nil {
+			var n Instruction
+			if err := binary.Read(bytes.NewReader(b), vm.Endianness, &n); err == nil {
+				next = &n
+			}
+		}
 	}
+	fmt.Println(Format(i, next, vm.Endianness))
 }
 
 func (vm *VM) getSrc(i *Instruction) uint8 {
-	switch vm.Endianness {
-	case binary.LittleEndian:
-		return i.DstSrc >> 4
-	default:
-		return i.DstSrc & 0b0000_1111
-	}
+	return decodeSrc(i, vm.Endianness)
 }
 
 func (vm *VM) getDst(i *Instruction) uint8 {
-	switch vm.Endianness {
-	case binary.LittleEndian:
-		return i.DstSrc & 0b0000_1111
-	default:
-		return i.DstSrc >> 4
-	}
+	return decodeDst(i, vm.Endianness)
 }
 
 func (vm *VM) getRegister(i uint8) uint64 {
@@ -309,7 +453,7 @@ func (vm *VM) debug() {
 	}
 	fmt.Println()
 	fmt.Println("Stack")
-	kk := vm.Stack[StackSize-50 : StackSize]
+	kk := vm.Memory.Stack.Data[len(vm.Memory.Stack.Data)-50:]
 
 	fmt.Printf("%+v\n", kk)
 }